@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------------
+// 结构化访问日志
+// ------------------------------------------------------------------
+
+// accessLogConfig 是 routes.json 顶层的访问日志配置, 控制日志落盘位置/轮转/采样/本地调试格式
+type accessLogConfig struct {
+	Path           string   `json:"path"`                     // 访问日志文件路径
+	MaxSizeBytes   int64    `json:"maxSizeBytes"`             // 触发轮转的文件大小阈值
+	MaxAge         duration `json:"maxAge"`                   // 触发轮转的文件存活时长阈值
+	SampleRate2xx  float64  `json:"sampleRate2xx"`            // 2xx 响应的采样率(0~1), 0 或未配置表示全量记录; 4xx/5xx 始终全量记录
+	TrustedProxies []string `json:"trustedProxies,omitempty"` // 允许信任其 X-Forwarded-For 的前置代理 CIDR 列表
+	Console        bool     `json:"console"`                  // 是否额外以人类可读格式输出到控制台, 供本地开发使用
+}
+
+func (c accessLogConfig) sampleRate() float64 {
+	if c.SampleRate2xx <= 0 || c.SampleRate2xx > 1 {
+		return 1
+	}
+	return c.SampleRate2xx
+}
+
+// accessLogEntry 是单次请求对应的结构化日志条目, 序列化为一行 JSON 写入访问日志
+type accessLogEntry struct {
+	Timestamp     string  `json:"timestamp"`
+	Level         string  `json:"level"`
+	RequestID     string  `json:"requestId"`
+	ClientIP      string  `json:"clientIp"`
+	Method        string  `json:"method"`
+	Route         string  `json:"route,omitempty"`
+	Path          string  `json:"path"`
+	RewrittenPath string  `json:"rewrittenPath,omitempty"`
+	UpstreamHost  string  `json:"upstreamHost,omitempty"`
+	Status        int     `json:"status"`
+	BytesIn       int64   `json:"bytesIn"`
+	BytesOut      int64   `json:"bytesOut"`
+	UpstreamMs    float64 `json:"upstreamMs,omitempty"`
+	TotalMs       float64 `json:"totalMs"`
+	Cache         string  `json:"cache,omitempty"`
+	BreakerState  string  `json:"breakerState,omitempty"`
+}
+
+// accessLogger 把访问日志写成按大小/时间轮转的 JSON 文件, 2xx 响应按采样率丢弃一部分以控制日志量,
+// 4xx/5xx 响应始终全量记录; console 开启时额外打印一行人类可读摘要, 方便本地开发
+type accessLogger struct {
+	cfg            accessLogConfig
+	trustedProxies []*net.IPNet
+	console        *proxyLogger
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// newAccessLogger 打开(或创建)访问日志文件; console 非 nil 时额外打印人类可读摘要
+func newAccessLogger(cfg accessLogConfig, console *proxyLogger) (*accessLogger, error) {
+	al := &accessLogger{cfg: cfg}
+	if cfg.Console {
+		al.console = console
+	}
+	for _, cidr := range cfg.TrustedProxies {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			al.trustedProxies = append(al.trustedProxies, ipnet)
+		}
+	}
+	if err := al.openLocked(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *accessLogger) openLocked() error {
+	f, err := os.OpenFile(al.cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.file = f
+	al.size = info.Size()
+	al.openedAt = time.Now()
+	return nil
+}
+
+// rotateLocked 把当前日志文件归档为带时间戳的文件名, 再打开一个新文件继续写入
+func (al *accessLogger) rotateLocked() {
+	al.file.Close()
+	archived := fmt.Sprintf("%s.%s", al.cfg.Path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(al.cfg.Path, archived); err != nil {
+		// 归档失败就继续追加写当前文件, 下次达到阈值时再次尝试, 避免因为一次失败丢失后续日志
+		if f, ferr := os.OpenFile(al.cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); ferr == nil {
+			al.file = f
+		}
+		return
+	}
+	if err := al.openLocked(); err != nil && al.console != nil {
+		al.console.Errorf("访问日志轮转后重新打开文件失败: %v", err)
+	}
+}
+
+func (al *accessLogger) needsRotateLocked() bool {
+	if al.cfg.MaxSizeBytes > 0 && al.size >= al.cfg.MaxSizeBytes {
+		return true
+	}
+	if al.cfg.MaxAge.value() > 0 && time.Since(al.openedAt) >= al.cfg.MaxAge.value() {
+		return true
+	}
+	return false
+}
+
+// log 按采样规则决定是否写入, 追加一行 JSON 到轮转文件, console 模式下额外打印一行摘要
+func (al *accessLogger) log(e accessLogEntry) {
+	if al == nil {
+		return
+	}
+	if e.Status >= 200 && e.Status < 300 && mathrand.Float64() >= al.cfg.sampleRate() {
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	al.mu.Lock()
+	if al.needsRotateLocked() {
+		al.rotateLocked()
+	}
+	n, werr := al.file.Write(line)
+	if werr == nil {
+		al.size += int64(n)
+	}
+	al.mu.Unlock()
+
+	if al.console != nil {
+		al.console.Printf("访问日志: [%s] %s %s -> %d %s (route=%s upstream=%s cache=%s total=%.1fms)",
+			e.RequestID, e.Method, e.Path, e.Status, e.BreakerState, e.Route, e.UpstreamHost, e.Cache, e.TotalMs)
+	}
+}
+
+// Close 关闭底层日志文件
+func (al *accessLogger) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.file.Close()
+}
+
+// ------------------------------------------------------------------
+// 请求 ID 与客户端 IP
+// ------------------------------------------------------------------
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDFromContext 从请求 context 中取出请求 ID, 未注入时返回空字符串
+func requestIDFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(requestIDCtxKey).(string)
+	return v
+}
+
+// newRequestID 生成一个 16 字节的随机十六进制请求 ID
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := cryptorand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// clientIP 解析请求的真实客户端 IP: 仅当 RemoteAddr 命中 trustedProxies 时才采信
+// X-Forwarded-For 的最左侧(最原始)一跳, 否则一律使用 RemoteAddr, 避免客户端伪造请求头绕过限流/日志审计
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if len(trustedProxies) == 0 || !ipTrusted(host, trustedProxies) {
+		return host
+	}
+
+	xff := r.Header.Get("X-Forwarded-For")
+	if xff == "" {
+		return host
+	}
+	parts := strings.Split(xff, ",")
+	return strings.TrimSpace(parts[0])
+}
+
+func ipTrusted(host string, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range trustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------
+// HTTP 层: 访问日志中间件
+// ------------------------------------------------------------------
+
+// accessRecorder 包装 http.ResponseWriter 以捕获状态码和已写出的字节数, 保留 Hijacker 透传以兼容 WebSocket 劫持
+type accessRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytesOut  int64
+	wroteHead bool
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	r.status = status
+	r.wroteHead = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(p []byte) (int, error) {
+	if !r.wroteHead {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytesOut += int64(n)
+	return n, err
+}
+
+func (r *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("底层 ResponseWriter 不支持连接劫持")
+	}
+	return hj.Hijack()
+}
+
+// Unwrap 暴露底层 ResponseWriter, 使 http.NewResponseController 能穿透这层包装找到
+// 真正支持 SetReadDeadline/SetWriteDeadline/Flush 的底层实现(例如 streamTimeout、SSE/流式响应的 Flush)
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// accessLogMiddleware 是最外层中间件: 生成/透传请求 ID, 解析真实客户端 IP, 并在请求结束后
+// 写出一条结构化访问日志(汇总 Director/ModifyResponse 经由 proxyAttempt 记录下来的路由/上游/耗时信息)
+func accessLogMiddleware(next http.Handler, al *accessLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		reqID := r.Header.Get(requestIDHeader)
+		if reqID == "" {
+			reqID = newRequestID()
+		}
+		ctx := context.WithValue(r.Context(), requestIDCtxKey, reqID)
+		r = r.WithContext(ctx)
+		w.Header().Set(requestIDHeader, reqID)
+
+		ip := clientIP(r, al.trustedProxies)
+
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		p, _, exists := findRoute(r.URL.Path)
+		entry := accessLogEntry{
+			Timestamp: start.UTC().Format(time.RFC3339Nano),
+			Level:     levelForStatus(rec.status),
+			RequestID: reqID,
+			ClientIP:  ip,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    rec.status,
+			BytesIn:   r.ContentLength,
+			BytesOut:  rec.bytesOut,
+			TotalMs:   float64(time.Since(start).Microseconds()) / 1000,
+			Cache:     rec.Header().Get("X-Cache"),
+		}
+		if exists {
+			entry.Route = p.prefix
+		}
+		if attempt := attemptFromContext(r.Context()); attempt != nil {
+			entry.RewrittenPath = attempt.rewrittenPath
+			entry.UpstreamMs = attempt.upstreamMs
+			if attempt.chosen != nil {
+				entry.UpstreamHost = attempt.chosen.target.Host
+				if attempt.chosen.breaker != nil {
+					entry.BreakerState = attempt.chosen.breaker.snapshot()
+				}
+			}
+		}
+
+		al.log(entry)
+	})
+}
+
+// levelForStatus 按状态码把访问日志条目映射为 debug/info/warn/error 四个级别之一
+func levelForStatus(status int) string {
+	switch {
+	case status >= 500:
+		return "error"
+	case status >= 400:
+		return "warn"
+	case status >= 300:
+		return "info"
+	default:
+		return "debug"
+	}
+}
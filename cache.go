@@ -0,0 +1,356 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 缓存相关默认值与落盘路径
+const (
+	defaultCacheMaxEntrySize = 8 * 1024 * 1024   // 单条缓存的默认大小上限
+	cacheMaxTotalSize        = 512 * 1024 * 1024 // 缓存总大小上限(内存+磁盘合计)
+	cacheDiskDir             = "cache"           // 超过阈值的缓存体落盘目录, 为空则禁用落盘
+	cacheDiskThreshold       = 256 * 1024        // 超过该大小的缓存体落盘存储而非常驻内存
+	cacheSweepInterval       = 60 * time.Second  // 过期缓存清理周期
+)
+
+// cacheConfig 是 routes.json 中单个路由的响应缓存规则
+type cacheConfig struct {
+	ContentTypes []string `json:"contentTypes"` // 例如 "image/*"、"video/*"
+	PathRegex    string   `json:"pathRegex"`
+	TTL          duration `json:"ttl"`
+	MaxEntrySize int64    `json:"maxEntrySize"`
+	Vary         []string `json:"vary"` // 参与缓存 key 计算的请求头
+
+	re *regexp.Regexp
+}
+
+func (c cacheConfig) enabled() bool {
+	return len(c.ContentTypes) > 0 || c.PathRegex != ""
+}
+
+// matches 判断响应是否满足该路由的缓存规则
+func (c cacheConfig) matches(contentType, path string) bool {
+	if c.re != nil && !c.re.MatchString(path) {
+		return false
+	}
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+	for _, pattern := range c.ContentTypes {
+		if matchContentType(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchContentType(pattern, actual string) bool {
+	actual = strings.TrimSpace(strings.SplitN(actual, ";", 2)[0])
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(actual, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == actual
+}
+
+// cacheKey 按 方法 + 最终路径 + 选定请求头 计算缓存键, 体现 Vary 语义
+func cacheKey(p *pool, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('|')
+	b.WriteString(r.URL.Path)
+	for _, name := range p.cache.Vary {
+		b.WriteByte('|')
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(r.Header.Get(name))
+	}
+	return b.String()
+}
+
+// cacheEntry 是缓存中的一条响应记录
+type cacheEntry struct {
+	key          string
+	status       int
+	header       http.Header
+	body         []byte // diskPath 非空时为空, 体从磁盘读取
+	diskPath     string
+	size         int64
+	etag         string
+	lastModified string
+	expiresAt    time.Time
+}
+
+func (e *cacheEntry) stale() bool {
+	return time.Now().After(e.expiresAt)
+}
+
+// responseCache 是一个支持 LRU 淘汰、可选落盘的响应缓存
+type responseCache struct {
+	mu      sync.Mutex
+	items   map[string]*list.Element // key -> list element, element.Value 是 *cacheEntry
+	order   *list.List               // front = 最近使用
+	curSize int64
+	maxSize int64
+	diskDir string
+}
+
+func newResponseCache(maxSize int64, diskDir string) *responseCache {
+	if diskDir != "" {
+		_ = os.MkdirAll(diskDir, 0o755)
+	}
+	return &responseCache{
+		items:   make(map[string]*list.Element),
+		order:   list.New(),
+		maxSize: maxSize,
+		diskDir: diskDir,
+	}
+}
+
+// get 返回缓存项(可能已过期, 由调用方决定是否需要条件验证), 命中时刷新 LRU 位置
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry), true
+}
+
+// set 写入/替换一条缓存, 必要时淘汰最久未使用的条目为新条目腾出空间
+func (c *responseCache) set(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.items[e.key]; ok {
+		c.removeLocked(old)
+	}
+
+	if c.diskDir != "" && e.size > cacheDiskThreshold {
+		if path, err := c.writeToDisk(e); err == nil {
+			e.diskPath = path
+			e.body = nil
+		}
+	}
+
+	for c.curSize+e.size > c.maxSize && c.order.Back() != nil {
+		c.removeLocked(c.order.Back())
+	}
+
+	elem := c.order.PushFront(e)
+	c.items[e.key] = elem
+	c.curSize += e.size
+}
+
+// touch 用于条件验证(304)之后刷新既有缓存项的过期时间与 LRU 位置
+func (c *responseCache) touch(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[e.key]; ok {
+		c.order.MoveToFront(elem)
+	}
+}
+
+func (c *responseCache) removeLocked(elem *list.Element) {
+	e := elem.Value.(*cacheEntry)
+	if e.diskPath != "" {
+		os.Remove(e.diskPath)
+	}
+	delete(c.items, e.key)
+	c.order.Remove(elem)
+	c.curSize -= e.size
+}
+
+// writeToDisk 把缓存体落盘, 返回文件路径
+func (c *responseCache) writeToDisk(e *cacheEntry) (string, error) {
+	name := strconv.FormatUint(hashString(e.key), 16)
+	path := filepath.Join(c.diskDir, name+".cache")
+	if err := os.WriteFile(path, e.body, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// body 返回缓存体, 磁盘存储的条目按需读取
+func (e *cacheEntry) loadBody() []byte {
+	if e.diskPath == "" {
+		return e.body
+	}
+	data, err := os.ReadFile(e.diskPath)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// sweepExpired 周期性清理已过期且长期未被访问的缓存项, 避免过期元数据无限堆积
+func (c *responseCache) sweepExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var next *list.Element
+	for elem := c.order.Back(); elem != nil; elem = next {
+		next = elem.Prev()
+		if elem.Value.(*cacheEntry).stale() {
+			c.removeLocked(elem)
+		}
+	}
+}
+
+// startCacheSweeper 启动后台清理 goroutine
+func startCacheSweeper(c *responseCache) {
+	ticker := time.NewTicker(cacheSweepInterval)
+	go func() {
+		for range ticker.C {
+			c.sweepExpired()
+		}
+	}()
+}
+
+// ------------------------------------------------------------------
+// HTTP 层: 缓存中间件
+// ------------------------------------------------------------------
+
+// cacheRecorder 包装 http.ResponseWriter, 在把响应写给客户端的同时把响应体
+// tee 进一个有界缓冲区, 供命中规则时写入缓存; 超出大小上限则放弃缓存但继续转发
+type cacheRecorder struct {
+	http.ResponseWriter
+	status        int
+	headerWritten bool
+	buf           []byte
+	limit         int64
+	captured      bool
+	bufPool       *bufferPool
+}
+
+func newCacheRecorder(w http.ResponseWriter, limit int64, bufPool *bufferPool) *cacheRecorder {
+	if limit <= 0 {
+		limit = defaultCacheMaxEntrySize
+	}
+	return &cacheRecorder{ResponseWriter: w, limit: limit, captured: true, status: http.StatusOK, bufPool: bufPool}
+}
+
+func (r *cacheRecorder) WriteHeader(status int) {
+	r.status = status
+	r.headerWritten = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *cacheRecorder) Write(p []byte) (int, error) {
+	if !r.headerWritten {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.captured {
+		if int64(len(r.buf)+len(p)) > r.limit {
+			r.captured = false
+			r.buf = nil
+		} else {
+			buf := r.bufPool.Get()
+			n := copy(buf, p)
+			r.buf = append(r.buf, buf[:n]...)
+			if n < len(p) {
+				r.buf = append(r.buf, p[n:]...)
+			}
+			r.bufPool.Put(buf)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap 暴露底层 ResponseWriter, 使 http.NewResponseController 能穿透这层包装找到
+// 真正支持 SetReadDeadline/SetWriteDeadline/Flush 的底层实现(例如 streamTimeout、SSE/流式响应的 Flush)
+func (r *cacheRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// cacheMiddleware 在命中缓存时直接返回, 未命中/未过期时转发给 next 并按需缓存响应
+func cacheMiddleware(next http.Handler, rc *responseCache, bufPool *bufferPool, logger *proxyLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _, exists := findRoute(r.URL.Path)
+		if !exists || !p.cache.enabled() || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := cacheKey(p, r)
+		entry, hit := rc.get(key)
+		if hit && !entry.stale() {
+			atomic.AddInt64(&p.cacheHits, 1)
+			serveFromCache(w, entry, requestIDFromContext(r.Context()))
+			networkDataCount += float64(entry.size) / (1024 * 1024) // 命中缓存也计入流量统计(节省的回源流量)
+			logger.Printf("缓存命中: %s %s", r.Method, r.URL.Path)
+			return
+		}
+		atomic.AddInt64(&p.cacheMisses, 1)
+
+		if hit {
+			// 缓存已过期, 尝试条件请求做回源验证
+			if entry.etag != "" {
+				r.Header.Set("If-None-Match", entry.etag)
+			}
+			if entry.lastModified != "" {
+				r.Header.Set("If-Modified-Since", entry.lastModified)
+			}
+		}
+
+		rec := newCacheRecorder(w, p.cache.MaxEntrySize, bufPool)
+		next.ServeHTTP(rec, r)
+
+		if rec.status == http.StatusNotModified && hit {
+			entry.expiresAt = time.Now().Add(p.cache.TTL.value())
+			rc.touch(entry)
+			return
+		}
+
+		if rec.status == http.StatusOK && rec.captured && rec.buf != nil &&
+			p.cache.matches(rec.Header().Get("Content-Type"), r.URL.Path) &&
+			!strings.Contains(rec.Header().Get("Cache-Control"), "no-store") {
+			storedHeader := rec.Header().Clone()
+			stripPerRequestHeaders(storedHeader)
+			rc.set(&cacheEntry{
+				key:          key,
+				status:       rec.status,
+				header:       storedHeader,
+				body:         rec.buf,
+				size:         int64(len(rec.buf)),
+				etag:         rec.Header().Get("ETag"),
+				lastModified: rec.Header().Get("Last-Modified"),
+				expiresAt:    time.Now().Add(p.cache.TTL.value()),
+			})
+		}
+	})
+}
+
+// stripPerRequestHeaders 从即将缓存的响应头中剔除只应属于本次请求的头部, 避免它们被
+// 原样重放给之后命中缓存的其他客户端: Set-Cookie 是第一次回源那次请求的会话/追踪 cookie,
+// X-Request-Id 是第一次回源那次请求的请求 ID, 两者都不应该被共享
+func stripPerRequestHeaders(h http.Header) {
+	h.Del("Set-Cookie")
+	h.Del(requestIDHeader)
+}
+
+// serveFromCache 把缓存条目原样写回客户端, 并标记 X-Cache: HIT; reqID 是当前这次命中请求
+// 自己的请求 ID(而不是写入缓存时那次回源请求的 ID), 命中时需要重新盖上去
+func serveFromCache(w http.ResponseWriter, e *cacheEntry, reqID string) {
+	hdr := w.Header()
+	for k, v := range e.header {
+		hdr[k] = v
+	}
+	if reqID != "" {
+		hdr.Set(requestIDHeader, reqID)
+	}
+	hdr.Set("X-Cache", "HIT")
+	w.WriteHeader(e.status)
+	w.Write(e.loadBody())
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// appConfig 是配置文件(routesFilePath 指向的文件)的顶层结构。
+// Listen/CertFile/KeyFile/超时/缓冲区/连接池这几项只在进程启动时读取一次, 改动后需要重启才能生效;
+// Routes、FixedHeaders、证书内容本身支持通过 startConfigReloader 热重载。
+type appConfig struct {
+	Listen              string                 `json:"listen"`
+	CertFile            string                 `json:"certFile"`
+	KeyFile             string                 `json:"keyFile"`
+	SkipTLSVerify       *bool                  `json:"skipTlsVerify"`
+	ReadTimeout         duration               `json:"readTimeout"`
+	WriteTimeout        duration               `json:"writeTimeout"`
+	IdleTimeout         duration               `json:"idleTimeout"`
+	BufferSizeBytes     int                    `json:"bufferSizeBytes"`
+	BufferIdleTimeout   duration               `json:"bufferIdleTimeout"`
+	MaxIdleConns        int                    `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int                    `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int                    `json:"maxConnsPerHost"`
+	FixedHeaders        map[string]string      `json:"fixedHeaders,omitempty"`
+	AccessLog           accessLogConfig        `json:"accessLog,omitempty"`
+	Routes              map[string]routeConfig `json:"routes"`
+}
+
+// activeConfig 是当前生效的配置快照, 用于热重载时输出结构化 diff; 仅在 main goroutine 和
+// applyAppConfig(总是串行调用, 见 reload.go)中访问, 不需要额外加锁
+var activeConfig *appConfig
+
+func orString(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func orInt(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func orDuration(v, def time.Duration) time.Duration {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func orInt64(v, def int64) int64 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func orFloat(v, def float64) float64 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// readAppConfig 读取并校验配置文件, 校验失败时不返回任何半成品配置
+func readAppConfig(path string) (*appConfig, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg appConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %w", err)
+	}
+	if err := validateAppConfig(&cfg); err != nil {
+		return nil, fmt.Errorf("配置校验未通过: %w", err)
+	}
+	return &cfg, nil
+}
+
+// validateAppConfig 对配置做结构性校验, 相当于一份手写的 JSON Schema,
+// 在真正构建 pool 之前挡掉明显错误的配置, 避免校验失败的配置影响当前已生效的状态
+func validateAppConfig(cfg *appConfig) error {
+	if len(cfg.Routes) == 0 {
+		return fmt.Errorf("未配置任何路由(routes)")
+	}
+
+	for prefix, rc := range cfg.Routes {
+		if len(rc.Upstreams) == 0 {
+			return fmt.Errorf("路由 %q 未配置任何上游节点(upstreams)", prefix)
+		}
+		for i, u := range rc.Upstreams {
+			if u.URL == "" {
+				return fmt.Errorf("路由 %q 的第 %d 个上游节点缺少 url", prefix, i)
+			}
+		}
+
+		switch rc.Policy {
+		case "", policyRoundRobin, policyWeighted, policyConsistentHash:
+		default:
+			return fmt.Errorf("路由 %q 的 policy %q 不是合法取值", prefix, rc.Policy)
+		}
+		if rc.Policy == policyConsistentHash && rc.HashKey.Type == "" {
+			return fmt.Errorf("路由 %q 使用 consistent_hash 时必须配置 hashKey", prefix)
+		}
+
+		switch rc.Protocol {
+		case "", protocolHTTP, protocolWS, protocolGRPC:
+		default:
+			return fmt.Errorf("路由 %q 的 protocol %q 不是合法取值", prefix, rc.Protocol)
+		}
+	}
+	return nil
+}
+
+// routeConfigChanged 判断单个路由前缀的配置在两次加载之间是否发生了变化,
+// diffAppConfig 和 applyAppConfig(决定是否需要重建 pool)共用同一个比较口径
+func routeConfigChanged(old, new routeConfig) bool {
+	ob, _ := json.Marshal(old)
+	nb, _ := json.Marshal(new)
+	return string(ob) != string(nb)
+}
+
+// diffAppConfig 返回新旧配置之间的结构化变更描述, 供重载时写入日志;
+// old 为 nil 表示这是进程启动时的首次加载
+func diffAppConfig(old, new *appConfig) []string {
+	if old == nil {
+		return []string{"初始加载配置"}
+	}
+
+	var changes []string
+	restartFields := []struct {
+		name           string
+		oldVal, newVal interface{}
+	}{
+		{"listen", old.Listen, new.Listen},
+		{"certFile", old.CertFile, new.CertFile},
+		{"keyFile", old.KeyFile, new.KeyFile},
+		{"readTimeout", old.ReadTimeout.value(), new.ReadTimeout.value()},
+		{"writeTimeout", old.WriteTimeout.value(), new.WriteTimeout.value()},
+		{"idleTimeout", old.IdleTimeout.value(), new.IdleTimeout.value()},
+		{"bufferSizeBytes", old.BufferSizeBytes, new.BufferSizeBytes},
+		{"bufferIdleTimeout", old.BufferIdleTimeout.value(), new.BufferIdleTimeout.value()},
+		{"maxIdleConns", old.MaxIdleConns, new.MaxIdleConns},
+		{"maxIdleConnsPerHost", old.MaxIdleConnsPerHost, new.MaxIdleConnsPerHost},
+		{"maxConnsPerHost", old.MaxConnsPerHost, new.MaxConnsPerHost},
+	}
+	for _, f := range restartFields {
+		if fmt.Sprint(f.oldVal) != fmt.Sprint(f.newVal) {
+			changes = append(changes, fmt.Sprintf("%s(需重启生效): %v -> %v", f.name, f.oldVal, f.newVal))
+		}
+	}
+
+	if fmt.Sprint(old.FixedHeaders) != fmt.Sprint(new.FixedHeaders) {
+		changes = append(changes, fmt.Sprintf("fixedHeaders: %v -> %v", old.FixedHeaders, new.FixedHeaders))
+	}
+
+	remaining := make(map[string]bool, len(old.Routes))
+	for prefix := range old.Routes {
+		remaining[prefix] = true
+	}
+	for prefix, nrc := range new.Routes {
+		orc, existed := old.Routes[prefix]
+		if !existed {
+			changes = append(changes, fmt.Sprintf("路由 %q: 新增", prefix))
+			continue
+		}
+		delete(remaining, prefix)
+		if routeConfigChanged(orc, nrc) {
+			changes = append(changes, fmt.Sprintf("路由 %q: 配置已变更", prefix))
+		}
+	}
+	for prefix := range remaining {
+		changes = append(changes, fmt.Sprintf("路由 %q: 已移除", prefix))
+	}
+
+	if len(changes) == 0 {
+		changes = append(changes, "配置内容无变化")
+	}
+	return changes
+}
+
+// applyAppConfig 把校验通过的配置应用为当前生效状态: 按路由对比新旧配置, 配置未变化的
+// 路由直接复用现有 pool(保留上游健康状态/熔断器/限流器令牌桶等运行时状态), 只为新增或
+// 配置发生变化的路由重建 pool; 合并全局/路由级的 fixedHeaders 与 tlsVerify 覆盖, 记录结构化 diff。
+// 任意一条路由构建失败都会直接返回错误, 不会触碰当前已生效的 routes/fixedHeaders
+func applyAppConfig(cfg *appConfig, logger *proxyLogger) error {
+	globalSkipVerify := defaultSkipTLSVerify
+	if cfg.SkipTLSVerify != nil {
+		globalSkipVerify = *cfg.SkipTLSVerify
+	}
+	globalHeaders := cfg.FixedHeaders
+	if globalHeaders == nil {
+		globalHeaders = defaultFixedHeaders
+	}
+
+	routeMutex.RLock()
+	oldRoutes := routes
+	routeMutex.RUnlock()
+	var oldRouteCfgs map[string]routeConfig
+	if activeConfig != nil {
+		oldRouteCfgs = activeConfig.Routes
+	}
+
+	newRoutes := make(map[string]*pool, len(cfg.Routes))
+	reused := make(map[string]bool, len(cfg.Routes))
+	for prefix, rc := range cfg.Routes {
+		if oldP, existed := oldRoutes[prefix]; existed && !routeConfigChanged(oldRouteCfgs[prefix], rc) {
+			// 路由配置逐字节未变, 直接复用旧 pool, 避免重置上游健康状态/熔断器/限流器令牌桶
+			oldP.skipTLSVerify = globalSkipVerify
+			if rc.TLSVerify != nil {
+				oldP.skipTLSVerify = !*rc.TLSVerify
+			}
+			newRoutes[prefix] = oldP
+			reused[prefix] = true
+			continue
+		}
+
+		p, err := newPool(prefix, rc)
+		if err != nil {
+			return fmt.Errorf("加载路由 %q 失败: %w", prefix, err)
+		}
+		if p.retryBudget <= 0 {
+			p.retryBudget = defaultRetryBudget
+		}
+		if rc.FixedHeaders != nil {
+			p.fixedHeaders = rc.FixedHeaders
+		}
+		p.skipTLSVerify = globalSkipVerify
+		if rc.TLSVerify != nil {
+			p.skipTLSVerify = !*rc.TLSVerify
+		}
+		startHealthChecker(p, logger)
+		newRoutes[prefix] = p
+	}
+
+	routeMutex.Lock()
+	routes = newRoutes
+	routeMutex.Unlock()
+
+	fixedHeaders.Store(globalHeaders)
+
+	// 只停掉被替换或被移除的旧 pool 的健康检查 goroutine; 复用的 pool 继续用原来那一个
+	if oldRoutes != nil {
+		stale := make(map[string]*pool, len(oldRoutes))
+		for prefix, p := range oldRoutes {
+			if !reused[prefix] {
+				stale[prefix] = p
+			}
+		}
+		stopHealthCheckers(stale)
+	}
+
+	for _, line := range diffAppConfig(activeConfig, cfg) {
+		logger.Printf("配置变更: %s", line)
+	}
+	activeConfig = cfg
+
+	logger.Printf("配置已应用，共 %d 条路由(复用 %d 条)", len(routes), len(reused))
+	return nil
+}
+
+// loadAndApplyConfig 是重载入口: 读取、校验、应用一步到位, 任一环节出错都保留当前生效配置。
+// 先比较文件 mtime, 避免轮询兜底模式下把同一份未变化的配置反复应用一遍
+func loadAndApplyConfig(path string, logger *proxyLogger) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(lastMod) {
+		return nil
+	}
+
+	cfg, err := readAppConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := applyAppConfig(cfg, logger); err != nil {
+		return err
+	}
+	lastMod = info.ModTime()
+	return nil
+}
+
+// ------------------------------------------------------------------
+// TLS 证书热更新
+// ------------------------------------------------------------------
+
+// certHolder 通过 tls.Config.GetCertificate 回调让每次握手都取最新证书,
+// 从而支持运维在不重启进程的情况下轮换 tls.crt/tls.key
+type certHolder struct {
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertHolder() *certHolder {
+	return &certHolder{}
+}
+
+func (h *certHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.cert == nil {
+		return nil, fmt.Errorf("证书尚未加载")
+	}
+	return h.cert, nil
+}
+
+// reloadIfChanged 在证书或私钥文件的 mtime 发生变化时重新加载; 路径不变时可反复调用,
+// 供 startConfigReloader 在每次重载时机都顺带检查一次证书文件是否被运维原地替换
+func (h *certHolder) reloadIfChanged(certFile, keyFile string, logger *proxyLogger) error {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return fmt.Errorf("读取证书文件失败: %w", err)
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return fmt.Errorf("读取私钥文件失败: %w", err)
+	}
+
+	h.mu.RLock()
+	unchanged := h.cert != nil && !certInfo.ModTime().After(h.certModTime) && !keyInfo.ModTime().After(h.keyModTime)
+	h.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("加载证书失败: %w", err)
+	}
+
+	h.mu.Lock()
+	first := h.cert == nil
+	h.cert = &cert
+	h.certModTime = certInfo.ModTime()
+	h.keyModTime = keyInfo.ModTime()
+	h.mu.Unlock()
+
+	if !first {
+		logger.Printf("证书已热更新: %s / %s", certFile, keyFile)
+	}
+	return nil
+}
+
+// globalCertHolder 在 main() 中赋值一次, 供 startConfigReloader 在每次重载时机顺带刷新证书
+var globalCertHolder *certHolder
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// startHealthChecker 为 pool 中的每个上游节点启动主动健康检查
+// 周期性地 GET healthCheck.Path, 根据连续失败/恢复阈值切换节点的健康状态;
+// 拨测用的 client 沿用该路由自己的 skipTLSVerify 设置, 与 routeAwareTransport/dialUpstream
+// 对实际转发请求的处理保持一致, 否则自签名证书的上游会被健康检查误判为不健康
+func startHealthChecker(p *pool, logger *proxyLogger) {
+	client := &http.Client{
+		Timeout: p.healthCheck.Timeout.value(),
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: p.skipTLSVerify},
+		},
+	}
+	ticker := time.NewTicker(p.healthCheck.Interval.value())
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopHC:
+				return
+			case <-ticker.C:
+				for _, u := range p.upstreams {
+					checkUpstream(client, p, u, logger)
+				}
+			}
+		}
+	}()
+}
+
+// checkUpstream 对单个上游节点执行一次健康检查
+func checkUpstream(client *http.Client, p *pool, u *upstream, logger *proxyLogger) {
+	checkURL := *u.target
+	if p.healthCheck.Path != "" {
+		checkURL.Path = p.healthCheck.Path
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.healthCheck.Timeout.value())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		u.markFailure(p.healthCheck.FailThreshold)
+		return
+	}
+
+	wasHealthy := u.isHealthy()
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode >= 500 {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		u.markFailure(p.healthCheck.FailThreshold)
+	} else {
+		resp.Body.Close()
+		u.markSuccess(p.healthCheck.RecoverThreshold)
+	}
+
+	if wasHealthy != u.isHealthy() {
+		logger.Printf("健康检查: 路由 %q 节点 %s 状态变更为 healthy=%v", p.prefix, u.target.Host, u.isHealthy())
+	}
+}
+
+// stopHealthCheckers 停止一组 pool 对应的健康检查 goroutine, 用于配置重载时清理旧 pool
+func stopHealthCheckers(pools map[string]*pool) {
+	for _, p := range pools {
+		close(p.stopHC)
+	}
+}
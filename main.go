@@ -1,51 +1,58 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/json"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
-// 配置常量
+// 配置常量: 以下均为 config.json 对应字段缺省时使用的默认值,
+// 监听地址/证书路径/超时/缓冲区/连接池这些"需要重启才能生效"的设置在 main() 启动时从配置文件读取一次
 const (
-	// 基础参数
-	targetURL     = "https://www.xxx.com"                    // 目标服务器地址
-	listenAddr    = ":8443"                                  // 代理监听地址
-	certFile      = "/etc/ca/tls.crt"                        // TLS证书路径
-	keyFile       = "/etc/ca/tls.key"                        // TLS私钥路径
-	skipTLSVerify = true                                     // 是否全局跳过 TLS 证书验证
+	// 基础参数默认值
+	defaultListenAddr    = ":8443"           // 代理监听地址
+	defaultCertFile      = "/etc/ca/tls.crt" // TLS证书路径
+	defaultKeyFile       = "/etc/ca/tls.key" // TLS私钥路径
+	defaultSkipTLSVerify = true              // 是否全局跳过 TLS 证书验证
+
+	// 故障转移
+	defaultRetryBudget = 1               // 单个路由未配置 retryBudget 时的默认重试次数
+	maxRetryBodyBytes  = 4 * 1024 * 1024 // 故障转移重试时允许重放的请求体上限, 超出则放弃本次重试而不是重放残缺请求体
 
 	// 日志与配置路径
 	logFile        = "proxy.log"      // 日志文件路径
-	routesFilePath = "routes.json"    // 路由配置文件
-	reloadInterval = 10 * time.Second // 路由配置重载间隔
+	configFilePath = "routes.json"    // 配置文件路径(路由 + 运行时参数)
+	reloadInterval = 10 * time.Second // fsnotify 不可用时的轮询重载间隔兜底
 
-	// 缓冲区设置（每线程最大内存分配）
-	bufferSize        = 16 * 1024 * 1024 // 16MB 缓冲区
-	bufferIdleTimeout = 60 * time.Second // 缓冲池空闲超时时间
+	// 缓冲区设置默认值（每线程最大内存分配）
+	defaultBufferSize        = 16 * 1024 * 1024 // 16MB 缓冲区
+	defaultBufferIdleTimeout = 60 * time.Second // 缓冲池空闲超时时间
 
-	// HTTP客户端连接池设置
-	maxIdleConns        = 16 // 最大空闲连接数
-	maxIdleConnsPerHost = 16 // 每主机最大空闲连接数
-	maxConnsPerHost     = 16 // 每主机最大并发连接数
+	// HTTP客户端连接池设置默认值
+	defaultMaxIdleConns        = 16 // 最大空闲连接数
+	defaultMaxIdleConnsPerHost = 16 // 每主机最大空闲连接数
+	defaultMaxConnsPerHost     = 16 // 每主机最大并发连接数
 
-	// HTTP 服务器超时时间配置
-	readTimeout  = 30 * time.Second  // 读取请求超时
-	writeTimeout = 600 * time.Second // 响应写入超时，长时间传输（如视频）需设置较长
-	idleTimeout  = 120 * time.Second // 空闲连接最大存活时间
+	// HTTP 服务器超时时间默认值
+	defaultReadTimeout  = 30 * time.Second  // 读取请求超时
+	defaultWriteTimeout = 600 * time.Second // 响应写入超时，长时间传输（如视频）需设置较长
+	defaultIdleTimeout  = 120 * time.Second // 空闲连接最大存活时间
 
-	// 网络连接相关超时设置
+	// 网络连接相关超时设置(暂不随配置文件开放, 变动较少)
 	dialTimeout           = 30 * time.Second // 拨号超时时间
 	dialKeepAlive         = 60 * time.Second // TCP KeepAlive
 	idleConnTimeout       = 90 * time.Second // 空闲连接超时
@@ -54,36 +61,53 @@ const (
 
 	// 监控配置
 	memoryMonitoringInterval = 300 * time.Second // 内存监控输出间隔时间
+	metricsListenAddr        = ""                // Prometheus /metrics 与 pprof 监听地址, 留空表示禁用
+
+	// 访问日志默认值
+	defaultAccessLogPath          = "access.log"     // 访问日志文件路径
+	defaultAccessLogMaxSizeBytes  = 64 * 1024 * 1024 // 触发轮转的文件大小阈值
+	defaultAccessLogMaxAge        = 24 * time.Hour   // 触发轮转的文件存活时长阈值
+	defaultAccessLogSampleRate2xx = 1.0              // 2xx 响应默认全量记录
 )
 
-// 固定请求头设置
-var fixedHeaders = map[string]string{
-	"Host":       "www.xxx.com",
+// defaultFixedHeaders 是配置文件未指定 fixedHeaders 时使用的内置默认值
+var defaultFixedHeaders = map[string]string{
 	"User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/136.0.0.0 Safari/537.36",
-	"Referer":    "https://www.xxx.com",
 }
 
 // 全局变量
 var (
-	routeMutex       sync.RWMutex      // 路由映射表的读写锁
-	routes           map[string]string // 路由映射表
-	lastMod          time.Time         // 配置文件最后修改时间
-	networkDataCount float64           // 总流量消耗计数
+	routeMutex       sync.RWMutex     // 路由映射表的读写锁
+	routes           map[string]*pool // 路由前缀 -> 上游节点池
+	lastMod          time.Time        // 配置文件最后修改时间
+	networkDataCount float64          // 总流量消耗计数
+
+	fixedHeaders atomic.Value // 当前生效的全局固定请求头(map[string]string), 支持热重载
 )
 
+// activeFixedHeaders 返回当前生效的全局固定请求头
+func activeFixedHeaders() map[string]string {
+	if v, _ := fixedHeaders.Load().(map[string]string); v != nil {
+		return v
+	}
+	return defaultFixedHeaders
+}
+
 // bufferPool 实现带空闲超时的内存缓冲池
 type bufferPool struct {
-	pool      sync.Pool
-	size      int
-	idleTimer *time.Timer
-	mu        sync.Mutex
-	active    int // 当前活跃的缓冲区数量
+	pool        sync.Pool
+	size        int
+	idleTimer   *time.Timer
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	active      int // 当前活跃的缓冲区数量
 }
 
 // newBufferPool 创建指定大小的缓冲池
 func newBufferPool(size int, idleTimeout time.Duration) *bufferPool {
 	bp := &bufferPool{
-		size: size,
+		size:        size,
+		idleTimeout: idleTimeout,
 		pool: sync.Pool{
 			New: func() interface{} {
 				return make([]byte, size)
@@ -127,10 +151,17 @@ func (b *bufferPool) Put(buf []byte) {
 
 	// 如果没有活跃缓冲区，启动空闲计时器
 	if b.active <= 0 && b.idleTimer != nil {
-		b.idleTimer.Reset(bufferIdleTimeout)
+		b.idleTimer.Reset(b.idleTimeout)
 	}
 }
 
+// activeCount 返回当前正在使用中的缓冲区数量, 供 /metrics 上报
+func (b *bufferPool) activeCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
 // cleanup 清理缓冲池
 func (b *bufferPool) cleanup() {
 	b.mu.Lock()
@@ -177,82 +208,103 @@ func (l *proxyLogger) Printf(format string, v ...interface{}) {
 	l.fileLogger.Printf(format, v...)
 }
 
+// Debugf/Infof/Warnf/Errorf 是带级别前缀的日志输出方法, 供单次请求生命周期内的
+// 运维类消息(区别于 accesslog.go 中按请求汇总输出的结构化访问日志)使用
+func (l *proxyLogger) Debugf(format string, v ...interface{}) { l.Printf("[DEBUG] "+format, v...) }
+func (l *proxyLogger) Infof(format string, v ...interface{})  { l.Printf("[INFO] "+format, v...) }
+func (l *proxyLogger) Warnf(format string, v ...interface{})  { l.Printf("[WARN] "+format, v...) }
+func (l *proxyLogger) Errorf(format string, v ...interface{}) { l.Printf("[ERROR] "+format, v...) }
+
 // Close 关闭日志文件
 func (l *proxyLogger) Close() error {
 	return l.file.Close()
 }
 
-// loadRoutes 加载路由配置文件
-func loadRoutes(logger *proxyLogger) error {
-	fileInfo, err := os.Stat(routesFilePath)
-	if err != nil {
-		return err
-	}
-
-	// 检查文件是否修改过
-	if !fileInfo.ModTime().After(lastMod) {
-		return nil
-	}
-
-	file, err := ioutil.ReadFile(routesFilePath)
-	if err != nil {
-		return err
-	}
-
-	var config struct {
-		Routes map[string]string `json:"routes"`
-	}
-	if err := json.Unmarshal(file, &config); err != nil {
-		return err
-	}
-
-	routeMutex.Lock()
-	defer routeMutex.Unlock()
-	routes = config.Routes
-	lastMod = fileInfo.ModTime()
-
-	logger.Printf("路由配置已重新加载，共 %d 条路由", len(routes))
-	return nil
-}
-
-// startRouteReloader 启动定期重载路由配置的goroutine
-func startRouteReloader(logger *proxyLogger) {
-	ticker := time.NewTicker(reloadInterval)
-	go func() {
-		for range ticker.C {
-			if err := loadRoutes(logger); err != nil {
-				logger.Printf("路由配置重载失败: %v", err)
-			}
-		}
-	}()
-}
-
-// findRoute 查找路由映射
-// 返回: 路由前缀, 剩余路径, 是否找到
-func findRoute(path string) (string, string, bool) {
+// findRoute 查找路径对应的上游节点池
+// 返回: 节点池, 剩余路径, 是否找到
+func findRoute(path string) (*pool, string, bool) {
 	// 分割路径，获取前缀和剩余部分
 	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
 	if len(parts) < 1 {
-		return "", "", false
+		return nil, "", false
 	}
 
 	routeMutex.RLock()
 	defer routeMutex.RUnlock()
 
 	prefix := parts[0]
-	if route, exists := routes[prefix]; exists {
+	if p, exists := routes[prefix]; exists {
 		remainingPath := ""
 		if len(parts) > 1 {
 			remainingPath = parts[1]
 		}
-		return route, remainingPath, true
+		return p, remainingPath, true
 	}
-	return "", "", false
+	return nil, "", false
 }
 
 // 全局日志记录器
 var logger *proxyLogger
 
+// routeAwareTransport 按命中路由的 skipTLSVerify 配置在两个预构建的 Transport 间选择,
+// 使"per-route TLS verify"生效而不必为每个路由各自维护一份连接池; protocol: grpc 且上游为
+// 明文 http:// 时改走 h2c(cleartext HTTP/2), 因为 gRPC 的帧/trailer 依赖 HTTP/2, 而明文上游
+// 不会经过 TLS ALPN 协商出 HTTP/2, *http.Transport 只会以 HTTP/1.1 拨号
+type routeAwareTransport struct {
+	verify   *http.Transport  // TLS 证书校验开启
+	noVerify *http.Transport  // TLS 证书校验跳过
+	h2c      *http2.Transport // 明文 gRPC 上游专用, AllowHTTP 开启后按 HTTP/2 直接拨号
+}
+
+func (t *routeAwareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempt := attemptFromContext(req.Context())
+	if attempt != nil && attempt.pool != nil {
+		if attempt.pool.protocol == protocolGRPC && req.URL.Scheme == "http" {
+			return t.h2c.RoundTrip(req)
+		}
+		if attempt.pool.skipTLSVerify {
+			return t.noVerify.RoundTrip(req)
+		}
+	}
+	return t.verify.RoundTrip(req)
+}
+
+// bodyReplayBuffer 包装请求体, 读取的同时把读到的字节缓存下来(上限 maxRetryBodyBytes),
+// 供 ErrorHandler 故障转移重试时重放同一个请求体; http.Request.Clone 不会复制 Body,
+// 重试若直接复用原 Body 只会拿到一个已经被读到 EOF 的 ReadCloser。
+// 缓存内容一旦超出上限就放弃缓存(overflow), 这样重试时能明确知道"不能安全重放", 转而放弃重试
+type bodyReplayBuffer struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func newBodyReplayBuffer(body io.ReadCloser, limit int64) *bodyReplayBuffer {
+	return &bodyReplayBuffer{ReadCloser: body, limit: limit}
+}
+
+func (b *bodyReplayBuffer) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// replay 返回一个从头重新读取已缓存请求体的 ReadCloser; 请求体超出重放上限时返回 false
+func (b *bodyReplayBuffer) replay() (io.ReadCloser, bool) {
+	if b.overflow {
+		return nil, false
+	}
+	return io.NopCloser(bytes.NewReader(b.buf.Bytes())), true
+}
+
 func main() {
 	// 初始化日志系统
 	var err error
@@ -262,26 +314,60 @@ func main() {
 	}
 	defer logger.Close()
 
-	// 初始加载路由配置
-	if err := loadRoutes(logger); err != nil {
-		logger.Printf("初始路由配置加载失败: %v", err)
-		log.Fatalf("初始路由配置加载失败: %v", err)
+	// 初始加载配置文件: 监听地址/证书路径/超时/缓冲区/连接池这几项只在启动时读取一次,
+	// 后续改动需要重启进程才能生效; 路由、全局固定请求头、证书内容本身支持热重载(见 config.go/reload.go)
+	bootCfg, err := readAppConfig(configFilePath)
+	if err != nil {
+		log.Fatalf("初始配置加载失败: %v", err)
 	}
 
-	startRouteReloader(logger) // 启动定期重载
-
-	// 解析目标URL
-	target, err := url.Parse(targetURL)
+	listenAddr := orString(bootCfg.Listen, defaultListenAddr)
+	certFile := orString(bootCfg.CertFile, defaultCertFile)
+	keyFile := orString(bootCfg.KeyFile, defaultKeyFile)
+	skipTLSVerify := defaultSkipTLSVerify
+	if bootCfg.SkipTLSVerify != nil {
+		skipTLSVerify = *bootCfg.SkipTLSVerify
+	}
+	readTimeout := orDuration(bootCfg.ReadTimeout.value(), defaultReadTimeout)
+	writeTimeout := orDuration(bootCfg.WriteTimeout.value(), defaultWriteTimeout)
+	idleTimeout := orDuration(bootCfg.IdleTimeout.value(), defaultIdleTimeout)
+	bufferSize := orInt(bootCfg.BufferSizeBytes, defaultBufferSize)
+	bufferIdleTimeout := orDuration(bootCfg.BufferIdleTimeout.value(), defaultBufferIdleTimeout)
+	maxIdleConns := orInt(bootCfg.MaxIdleConns, defaultMaxIdleConns)
+	maxIdleConnsPerHost := orInt(bootCfg.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	maxConnsPerHost := orInt(bootCfg.MaxConnsPerHost, defaultMaxConnsPerHost)
+
+	// 访问日志: 路径/轮转阈值/采样率在启动时确定一次, 同 listen/certFile 等一样需要重启才能生效
+	accessLogCfg := bootCfg.AccessLog
+	accessLogCfg.Path = orString(accessLogCfg.Path, defaultAccessLogPath)
+	accessLogCfg.MaxSizeBytes = orInt64(accessLogCfg.MaxSizeBytes, defaultAccessLogMaxSizeBytes)
+	accessLogCfg.MaxAge = duration(orDuration(accessLogCfg.MaxAge.value(), defaultAccessLogMaxAge))
+	accessLogCfg.SampleRate2xx = orFloat(accessLogCfg.SampleRate2xx, defaultAccessLogSampleRate2xx)
+	accessLog, err := newAccessLogger(accessLogCfg, logger)
 	if err != nil {
-		logger.Printf("URL解析失败: %v", err)
-		log.Fatalf("URL解析失败: %v", err)
+		log.Fatalf("访问日志初始化失败: %v", err)
 	}
+	defer accessLog.Close()
 
-	// 创建反向代理实例
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	if err := applyAppConfig(bootCfg, logger); err != nil {
+		log.Fatalf("初始路由配置加载失败: %v", err)
+	}
+
+	// 证书通过 GetCertificate 回调加载, 配合 startConfigReloader 实现 tls.crt/tls.key 轮换不重启
+	certs := newCertHolder()
+	if err := certs.reloadIfChanged(certFile, keyFile, logger); err != nil {
+		log.Fatalf("初始证书加载失败: %v", err)
+	}
+	globalCertHolder = certs
+
+	startConfigReloader(configFilePath, certFile, keyFile, logger) // fsnotify(或轮询兜底) + SIGHUP 触发重载
+
+	// 创建反向代理实例, Director 会按路由选择的上游节点动态改写请求目标
+	proxy := &httputil.ReverseProxy{}
 	bufPool := newBufferPool(bufferSize, bufferIdleTimeout)
+	metricsBufPool = bufPool
 
-	// 配置传输层参数
+	// 配置传输层参数(verify/noVerify 两份, 按路由的 tlsVerify 覆盖动态选择, 见 routeAwareTransport)
 	transport := &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   dialTimeout,   // 拨号超时
@@ -300,77 +386,205 @@ func main() {
 		},
 		DisableCompression: true, // 禁用压缩
 	}
+	transportSkipVerify := transport.Clone()
+	transportSkipVerify.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
 
-	// 配置代理请求处理
+	// 明文(h2c) gRPC 上游专用 Transport: AllowHTTP 放开后对 http:// 目标也按 HTTP/2 直接拨号,
+	// 而不是走 TLS ALPN 协商; DialTLSContext 这个名字是 http2.Transport 的历史遗留, 这里实际拨的是明文 TCP
+	h2cTransport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{Timeout: dialTimeout, KeepAlive: dialKeepAlive}).DialContext(ctx, network, addr)
+		},
+	}
+
+	// 配置代理请求处理: 根据命中的路由池挑选一个健康的上游节点
 	proxy.Director = func(req *http.Request) {
-		// 查找路由映射
-		mappedPath, remainingPath, exists := findRoute(req.URL.Path)
-		if !exists {
-			req.Header.Set("X-Proxy-Invalid", "1") // 标记此请求为无效路由
+		p, remainingPath, exists := findRoute(req.URL.Path)
+		attempt := attemptFromContext(req.Context())
+		if !exists || attempt == nil {
+			// handler 在调用 ServeHTTP 前已校验路由存在并注入 attempt, 这里只是兜底
 			return
 		}
 
-		// 修改请求目标
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.Host = target.Host
+		u, err := p.pick(req, attempt.excluded)
+		if err != nil {
+			logger.Warnf("路由 %s 无可用上游节点: %v", req.URL.Path, err)
+			attempt.noHealthy = true
+			return // req.URL 保持未改写状态, RoundTrip 会失败并进入 ErrorHandler
+		}
+		attempt.chosen = u
+
+		// 修改请求目标为选中的上游节点
+		req.URL.Scheme = u.target.Scheme
+		req.URL.Host = u.target.Host
+		req.Host = u.target.Host
 
-		// 拼接新路径：映射路径 + 剩余路径
-		newPath := filepath.Join("/", mappedPath, remainingPath)
+		// 拼接新路径：上游基础路径 + 剩余路径
+		newPath := filepath.Join("/", u.target.Path, remainingPath)
 
-		// 设置固定请求头
-		for k, v := range fixedHeaders {
+		// 设置固定请求头(路由覆盖优先于全局配置)
+		for k, v := range attempt.pool.effectiveFixedHeaders() {
 			req.Header.Set(k, v)
 		}
 
-		// 移除不必要的请求头
+		// 移除不必要的请求头; If-Modified-Since 需要保留, 响应缓存的条件请求(cache.go)靠它触发 304
 		req.Header.Del("Accept-Encoding")
-		req.Header.Del("If-Modified-Since")
 
-		logger.Printf("转发路径: %s => %s", req.URL.Path, newPath)
+		// 透传请求 ID 给上游, 便于跨服务关联同一次请求的日志
+		if reqID := requestIDFromContext(req.Context()); reqID != "" {
+			req.Header.Set(requestIDHeader, reqID)
+		}
+
+		attempt.rewrittenPath = newPath
+		attempt.upstreamStart = time.Now()
+		logger.Debugf("转发路径: %s => %s%s (上游: %s)", req.URL.Path, u.target.Host, newPath, u.target.Host)
 
-		// 输出日志后映射路径
 		req.URL.Path = newPath
 	}
 
-	proxy.Transport = transport
+	proxy.Transport = &routeAwareTransport{verify: transport, noVerify: transportSkipVerify, h2c: h2cTransport}
 	proxy.BufferPool = bufPool
 
-	// 配置响应处理
+	// 配置响应处理: 统计流量, 并把 5xx 响应当作失败计入熔断/故障转移判断
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		attempt := attemptFromContext(resp.Request.Context())
+		if attempt != nil {
+			attempt.upstreamMs = float64(time.Since(attempt.upstreamStart).Microseconds()) / 1000
+		}
+
+		if resp.StatusCode >= 500 {
+			if attempt != nil && attempt.chosen != nil {
+				attempt.chosen.recordOutcome(false, attempt.pool.healthCheck.FailThreshold, attempt.pool.healthCheck.RecoverThreshold)
+			}
+			if attempt != nil && attempt.attempts < attempt.pool.retryBudget {
+				return errUpstreamFailure // 触发 ErrorHandler 做故障转移重试
+			}
+		} else if attempt != nil && attempt.chosen != nil {
+			attempt.chosen.recordOutcome(true, attempt.pool.healthCheck.FailThreshold, attempt.pool.healthCheck.RecoverThreshold)
+		}
+
 		// 设置CORS头
 		resp.Header.Set("Access-Control-Allow-Origin", "*")
+		if attempt != nil && attempt.pool.cache.enabled() {
+			resp.Header.Set("X-Cache", "MISS")
+		}
 		Size := float64(resp.ContentLength) / (1024 * 1024) // 请求文件的大小
-		logger.Printf("响应处理: Method: %s Code: %d Url: (%s) Size: %.2fMB",
-			resp.Request.Method,
-			resp.StatusCode,
-			resp.Request.URL.Path,
-			Size,
-		)
-		networkDataCount += Size // 网络请求数据总量计数
+		networkDataCount += Size                            // 网络请求数据总量计数
 		return nil
 	}
 
-	// 自定义请求处理函数
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+	// 故障转移: 连接失败、超时或 5xx(经 ModifyResponse 判定)都会走到这里,
+	// 在重试预算范围内换一个健康节点重新发起请求
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		attempt := attemptFromContext(r.Context())
+		if attempt == nil {
+			logger.Errorf("代理请求失败: %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+
+		if attempt.noHealthy {
+			logger.Warnf("路由 %s 无可用上游节点, 返回 503", r.URL.Path)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
 
-		// 判断 Director 设置的错误标志
-		if r.Header.Get("X-Proxy-Invalid") == "1" {
-			logger.Printf("[404] %s %s", r.Method, r.URL.Path)
+		if attempt.chosen != nil && err != errUpstreamFailure {
+			attempt.chosen.recordOutcome(false, attempt.pool.healthCheck.FailThreshold, attempt.pool.healthCheck.RecoverThreshold) // 连接级失败
+		}
+
+		if attempt.attempts >= attempt.pool.retryBudget {
+			logger.Errorf("故障转移预算耗尽: %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+
+		if attempt.chosen != nil {
+			attempt.excluded[attempt.chosen] = true
+		}
+		attempt.attempts++
+		attempt.chosen = nil
+
+		retryReq := r.Clone(r.Context())
+		if attempt.bodyReplay != nil {
+			body, ok := attempt.bodyReplay.replay()
+			if !ok {
+				logger.Warnf("请求体超出故障转移重放上限(%d 字节), 放弃重试: %s %s", maxRetryBodyBytes, r.Method, r.URL.Path)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			retryReq.Body = body
+		}
+
+		logger.Warnf("故障转移重试(%d/%d): %s %s: %v", attempt.attempts, attempt.pool.retryBudget, r.Method, r.URL.Path, err)
+		proxy.ServeHTTP(w, retryReq)
+	}
+
+	// 自定义请求处理函数; 每次请求的最终结果由最外层的 accessLogMiddleware 统一写出结构化访问日志,
+	// 这里只负责路由分发和故障转移状态的注入, 不再重复打印单次请求的摘要
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, remainingPath, exists := findRoute(r.URL.Path)
+		if !exists {
 			http.NotFound(w, r)
 			return
 		}
 
-		// 处理代理请求
+		// WebSocket 路由单独走连接劫持 + 双向转发, 不经过 httputil.ReverseProxy
+		if p.protocol == protocolWS && isWebSocketUpgrade(r) {
+			u, err := p.pick(r, nil)
+			if err != nil {
+				logger.Warnf("WebSocket 路由 %s 无可用上游节点: %v", r.URL.Path, err)
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			proxyWebSocket(w, r, u, filepath.Join("/", u.target.Path, remainingPath), p, bufPool, logger)
+			return
+		}
+
+		// gRPC 等长连接路由放宽读写超时, 避免被全局 writeTimeout 提前切断
+		if p.protocol == protocolGRPC {
+			extendDeadlinesForStreaming(w, p.streamTimeout.value())
+		}
+
+		// 为本次请求注入故障转移所需的状态(选中的节点、已排除节点、重试次数)
+		attempt := &proxyAttempt{pool: p, excluded: make(map[*upstream]bool)}
+
+		// 带请求体的请求(POST/PUT 上传, gRPC 一元/流式调用)在故障转移重试时不能直接复用原 Body
+		// (http.Request.Clone 不复制 Body, 且原 Body 此时已被第一次尝试读到 EOF), 这里用
+		// bodyReplayBuffer 边读边缓存, 超出上限则 ErrorHandler 会放弃重试而不是重放残缺请求体
+		if r.Body != nil && r.Body != http.NoBody {
+			rb := newBodyReplayBuffer(r.Body, maxRetryBodyBytes)
+			r.Body = rb
+			attempt.bodyReplay = rb
+		}
+
+		ctx := r.Context()
+		if p.requestTimeout.value() > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.requestTimeout.value())
+			defer cancel()
+		}
+		ctx = context.WithValue(ctx, attemptCtxKey, attempt)
+		r = r.WithContext(ctx)
+
 		proxy.ServeHTTP(w, r)
-		logger.Printf("请求对端文件: Method: [%s] Url: %s Source Address: %s Time consuming: %v",
-			r.Method,
-			r.URL.Path,
-			r.RemoteAddr,
-			time.Since(start))
 	})
 
+	// 管理端点(熔断器状态/限流拒绝计数), 与业务路由共用同一监听地址
+	respCache := newResponseCache(cacheMaxTotalSize, cacheDiskDir)
+	startCacheSweeper(respCache)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminStatusPath, adminStatusHandler)
+	mux.Handle("/", accessLogMiddleware(metricsMiddleware(rateLimitMiddleware(cacheMiddleware(handler, respCache, bufPool, logger), logger)), accessLog))
+
+	// 独立的监控管理监听地址(Prometheus /metrics + pprof), 默认禁用
+	startMetricsServer(metricsListenAddr, logger)
+
 	// 启动内存监控
 	go func() {
 		ticker := time.NewTicker(memoryMonitoringInterval)
@@ -388,13 +602,13 @@ func main() {
 		}
 	}()
 
-	// 配置HTTP服务器
+	// 配置HTTP服务器; 证书通过 GetCertificate 回调提供, 以支持不重启轮换
 	server := &http.Server{
 		Addr:    listenAddr,
-		Handler: handler,
+		Handler: mux,
 		TLSConfig: &tls.Config{
-			InsecureSkipVerify: skipTLSVerify,
-			MinVersion:         tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+			MinVersion:     tls.VersionTLS12,
 		},
 		ReadTimeout:  readTimeout,
 		WriteTimeout: writeTimeout,
@@ -404,14 +618,15 @@ func main() {
 	// 启动信息日志
 	logger.Printf("启动代理服务器...")
 	logger.Printf("监听地址: %s", listenAddr)
-	logger.Printf("目标地址: %s", targetURL)
+	logger.Printf("已加载路由数: %d", len(routes))
 	logger.Printf("缓冲区大小: %dMB", bufferSize/1024/1024)
 	logger.Printf("缓冲池空闲超时: %v", bufferIdleTimeout)
 	logger.Printf("连接池: 全局 %d, 每主机空闲 %d, 最大并发 %d", maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost)
-	logger.Printf("路由配置重载间隔: %v", reloadInterval)
+	logger.Printf("配置重载: fsnotify(文件系统不支持时每 %v 轮询一次) + SIGHUP", reloadInterval)
+	logger.Printf("访问日志: %s (2xx采样率 %.2f, console=%v)", accessLogCfg.Path, accessLogCfg.SampleRate2xx, accessLogCfg.Console)
 
-	// 启动服务器
-	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
+	// 启动服务器; 证书已通过 TLSConfig.GetCertificate 提供, 这里无需再传文件路径
+	if err := server.ListenAndServeTLS("", ""); err != nil {
 		logger.Printf("服务器启动失败: %v", err)
 		log.Fatalf("服务器启动失败: %v", err)
 	}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBucketsSeconds 是请求耗时直方图的桶边界(单位: 秒), 按 Prometheus histogram 的累积桶约定使用
+var latencyBucketsSeconds = []float64{0.01, 0.05, 0.1, 0.3, 0.5, 1, 2, 5, 10, 30}
+
+// routeMetrics 记录单个路由前缀的请求级指标
+type routeMetrics struct {
+	requestsTotal int64
+	inFlight      int64
+	bytesIn       int64
+	bytesOut      int64
+	statusClasses [5]int64 // 下标0~4分别对应 1xx~5xx
+
+	histMu  sync.Mutex
+	buckets []int64 // 与 latencyBucketsSeconds 一一对应的累积计数, 末尾额外一项是 +Inf
+	sum     float64 // 耗时总和(秒), 受 histMu 保护
+	count   int64   // 受 histMu 保护
+}
+
+func newRouteMetrics() *routeMetrics {
+	return &routeMetrics{buckets: make([]int64, len(latencyBucketsSeconds)+1)}
+}
+
+// routeMetricsStore 按路由前缀保存指标, key 为 string, value 为 *routeMetrics
+var routeMetricsStore sync.Map
+
+func metricsFor(prefix string) *routeMetrics {
+	v, _ := routeMetricsStore.LoadOrStore(prefix, newRouteMetrics())
+	return v.(*routeMetrics)
+}
+
+// observe 记录一次请求的耗时, 落入对应的累积直方图桶
+func (m *routeMetrics) observe(seconds float64) {
+	m.histMu.Lock()
+	defer m.histMu.Unlock()
+	m.sum += seconds
+	m.count++
+	for i, le := range latencyBucketsSeconds {
+		if seconds <= le {
+			m.buckets[i]++
+		}
+	}
+	m.buckets[len(m.buckets)-1]++ // +Inf 桶始终计入
+}
+
+func (m *routeMetrics) recordStatus(status int) {
+	class := status / 100
+	if class >= 1 && class <= 5 {
+		atomic.AddInt64(&m.statusClasses[class-1], 1)
+	}
+}
+
+// metricsBufPool 在 main() 中赋值一次, 供 /metrics 上报缓冲池活跃数使用
+var metricsBufPool *bufferPool
+
+// metricsRecorder 包装 http.ResponseWriter 以捕获状态码和已写出的字节数,
+// 不缓冲响应体, 仅做计数, 保留 Hijacker 透传以兼容 WebSocket 劫持
+type metricsRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytesOut  int64
+	wroteHead bool
+}
+
+func (r *metricsRecorder) WriteHeader(status int) {
+	r.status = status
+	r.wroteHead = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *metricsRecorder) Write(p []byte) (int, error) {
+	if !r.wroteHead {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytesOut += int64(n)
+	return n, err
+}
+
+// Hijack 透传给底层 ResponseWriter, 保证 WebSocket 路由的连接劫持不受指标中间件影响
+func (r *metricsRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("底层 ResponseWriter 不支持连接劫持")
+	}
+	return hj.Hijack()
+}
+
+// Unwrap 暴露底层 ResponseWriter, 使 http.NewResponseController 能穿透这层包装找到
+// 真正支持 SetReadDeadline/SetWriteDeadline/Flush 的底层实现(例如 streamTimeout、SSE/流式响应的 Flush)
+func (r *metricsRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// metricsMiddleware 包装 handler, 记录每个路由的请求数/耗时直方图/进行中请求数/出入流量,
+// 不需要改动 Director、ModifyResponse 或 handler 内部的业务逻辑
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _, exists := findRoute(r.URL.Path)
+		if !exists {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		m := metricsFor(p.prefix)
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+		atomic.AddInt64(&m.requestsTotal, 1)
+		if r.ContentLength > 0 {
+			atomic.AddInt64(&m.bytesIn, r.ContentLength)
+		}
+
+		start := time.Now()
+		rec := &metricsRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		m.observe(time.Since(start).Seconds())
+		m.recordStatus(rec.status)
+		atomic.AddInt64(&m.bytesOut, rec.bytesOut)
+	})
+}
+
+// writePrometheusMetrics 以 Prometheus 文本格式输出当前进程和各路由的指标快照
+func writePrometheusMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP proxy_requests_total 按路由统计的请求总数")
+	fmt.Fprintln(w, "# TYPE proxy_requests_total counter")
+	fmt.Fprintln(w, "# HELP proxy_requests_in_flight 当前正在处理的请求数")
+	fmt.Fprintln(w, "# TYPE proxy_requests_in_flight gauge")
+	fmt.Fprintln(w, "# HELP proxy_bytes_in_total 按路由统计的请求体字节数")
+	fmt.Fprintln(w, "# TYPE proxy_bytes_in_total counter")
+	fmt.Fprintln(w, "# HELP proxy_bytes_out_total 按路由统计的响应体字节数")
+	fmt.Fprintln(w, "# TYPE proxy_bytes_out_total counter")
+	fmt.Fprintln(w, "# HELP proxy_responses_total 按路由和状态码类别统计的响应数")
+	fmt.Fprintln(w, "# TYPE proxy_responses_total counter")
+	fmt.Fprintln(w, "# HELP proxy_request_duration_seconds 请求耗时直方图")
+	fmt.Fprintln(w, "# TYPE proxy_request_duration_seconds histogram")
+
+	prefixes := make([]string, 0)
+	routeMetricsStore.Range(func(k, _ interface{}) bool {
+		prefixes = append(prefixes, k.(string))
+		return true
+	})
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		v, _ := routeMetricsStore.Load(prefix)
+		m := v.(*routeMetrics)
+
+		fmt.Fprintf(w, "proxy_requests_total{route=%q} %d\n", prefix, atomic.LoadInt64(&m.requestsTotal))
+		fmt.Fprintf(w, "proxy_requests_in_flight{route=%q} %d\n", prefix, atomic.LoadInt64(&m.inFlight))
+		fmt.Fprintf(w, "proxy_bytes_in_total{route=%q} %d\n", prefix, atomic.LoadInt64(&m.bytesIn))
+		fmt.Fprintf(w, "proxy_bytes_out_total{route=%q} %d\n", prefix, atomic.LoadInt64(&m.bytesOut))
+		for i, class := range []string{"1xx", "2xx", "3xx", "4xx", "5xx"} {
+			fmt.Fprintf(w, "proxy_responses_total{route=%q,class=%q} %d\n", prefix, class, atomic.LoadInt64(&m.statusClasses[i]))
+		}
+
+		m.histMu.Lock()
+		for i, le := range latencyBucketsSeconds {
+			fmt.Fprintf(w, "proxy_request_duration_seconds_bucket{route=%q,le=\"%g\"} %d\n", prefix, le, m.buckets[i])
+		}
+		fmt.Fprintf(w, "proxy_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", prefix, m.buckets[len(m.buckets)-1])
+		fmt.Fprintf(w, "proxy_request_duration_seconds_sum{route=%q} %g\n", prefix, m.sum)
+		fmt.Fprintf(w, "proxy_request_duration_seconds_count{route=%q} %d\n", prefix, m.count)
+		m.histMu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP proxy_rate_limit_rejected_total 按路由统计的限流拒绝次数")
+	fmt.Fprintln(w, "# TYPE proxy_rate_limit_rejected_total counter")
+	fmt.Fprintln(w, "# HELP proxy_cache_hits_total 按路由统计的缓存命中次数")
+	fmt.Fprintln(w, "# TYPE proxy_cache_hits_total counter")
+	fmt.Fprintln(w, "# HELP proxy_cache_misses_total 按路由统计的缓存未命中次数")
+	fmt.Fprintln(w, "# TYPE proxy_cache_misses_total counter")
+	fmt.Fprintln(w, "# HELP proxy_upstream_healthy 上游节点健康状态(1=健康, 0=不健康)")
+	fmt.Fprintln(w, "# TYPE proxy_upstream_healthy gauge")
+	fmt.Fprintln(w, "# HELP proxy_circuit_breaker_state 熔断器状态(0=closed, 1=open, 2=half-open)")
+	fmt.Fprintln(w, "# TYPE proxy_circuit_breaker_state gauge")
+
+	routeMutex.RLock()
+	for prefix, p := range routes {
+		fmt.Fprintf(w, "proxy_rate_limit_rejected_total{route=%q} %d\n", prefix, atomic.LoadInt64(&p.rateLimitRejected))
+		fmt.Fprintf(w, "proxy_cache_hits_total{route=%q} %d\n", prefix, atomic.LoadInt64(&p.cacheHits))
+		fmt.Fprintf(w, "proxy_cache_misses_total{route=%q} %d\n", prefix, atomic.LoadInt64(&p.cacheMisses))
+		for _, u := range p.upstreams {
+			healthy := 0
+			if u.isHealthy() {
+				healthy = 1
+			}
+			fmt.Fprintf(w, "proxy_upstream_healthy{route=%q,upstream=%q} %d\n", prefix, u.target.Host, healthy)
+			if u.breaker != nil {
+				fmt.Fprintf(w, "proxy_circuit_breaker_state{route=%q,upstream=%q} %d\n", prefix, u.target.Host, breakerStateValue(u.breaker.snapshot()))
+			}
+		}
+	}
+	routeMutex.RUnlock()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Fprintln(w, "# HELP proxy_goroutines 当前 goroutine 数量")
+	fmt.Fprintln(w, "# TYPE proxy_goroutines gauge")
+	fmt.Fprintf(w, "proxy_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(w, "# HELP proxy_mem_alloc_bytes 当前已分配且仍在使用的堆内存字节数")
+	fmt.Fprintln(w, "# TYPE proxy_mem_alloc_bytes gauge")
+	fmt.Fprintf(w, "proxy_mem_alloc_bytes %d\n", ms.Alloc)
+	fmt.Fprintln(w, "# HELP proxy_mem_sys_bytes 从操作系统获取的内存总字节数")
+	fmt.Fprintln(w, "# TYPE proxy_mem_sys_bytes gauge")
+	fmt.Fprintf(w, "proxy_mem_sys_bytes %d\n", ms.Sys)
+	fmt.Fprintln(w, "# HELP proxy_gc_runs_total GC 运行次数")
+	fmt.Fprintln(w, "# TYPE proxy_gc_runs_total counter")
+	fmt.Fprintf(w, "proxy_gc_runs_total %d\n", ms.NumGC)
+
+	if metricsBufPool != nil {
+		fmt.Fprintln(w, "# HELP proxy_buffer_pool_active 缓冲池当前活跃缓冲区数量")
+		fmt.Fprintln(w, "# TYPE proxy_buffer_pool_active gauge")
+		fmt.Fprintf(w, "proxy_buffer_pool_active %d\n", metricsBufPool.activeCount())
+	}
+}
+
+// breakerStateValue 把熔断器状态字符串映射为 Prometheus gauge 惯用的数值编码
+func breakerStateValue(state string) int {
+	switch state {
+	case "open":
+		return 1
+	case "half-open":
+		return 2
+	default:
+		return 0
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePrometheusMetrics(w)
+}
+
+// startMetricsServer 启动独立的监控管理监听地址, 提供 Prometheus /metrics 和 net/http/pprof。
+// addr 为空时不启动, 默认禁用以避免额外暴露端口
+func startMetricsServer(addr string, logger *proxyLogger) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		logger.Printf("监控管理端口监听: %s (/metrics, /debug/pprof)", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Printf("监控管理端口启动失败: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ------------------------------------------------------------------
+// 令牌桶限流
+// ------------------------------------------------------------------
+
+// rateLimitConfig 是 routes.json 中单个路由的限流配置
+type rateLimitConfig struct {
+	Rate       float64 `json:"rate"`       // 每秒放入的令牌数
+	Burst      int     `json:"burst"`      // 桶容量(突发上限)
+	KeyBy      string  `json:"keyBy"`      // ip | header
+	HeaderName string  `json:"headerName"` // keyBy=header 时使用的请求头名称
+}
+
+func (c rateLimitConfig) enabled() bool {
+	return c.Rate > 0 && c.Burst > 0
+}
+
+// tokenBucket 是一个简单的令牌桶限流器
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		tokens:   float64(burst),
+		capacity: float64(burst),
+		rate:     rate,
+		last:     time.Now(),
+	}
+}
+
+// allow 尝试消耗一个令牌, 拒绝时返回建议的 Retry-After
+func (b *tokenBucket) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.last)
+	b.last = now
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	// 距离下一个令牌产生还需要多久
+	missing := 1 - b.tokens
+	retryAfter := time.Duration(missing/b.rate*1000) * time.Millisecond
+	return false, retryAfter
+}
+
+// rateLimitKey 根据路由配置从请求中提取限流维度的 key
+func rateLimitKey(cfg rateLimitConfig, r *http.Request) string {
+	if cfg.KeyBy == "header" && cfg.HeaderName != "" {
+		if v := r.Header.Get(cfg.HeaderName); v != "" {
+			return v
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// allowRequest 检查给定 key 是否还有可用令牌, 不存在的桶会被懒加载创建
+func (p *pool) allowRequest(key string) (bool, time.Duration) {
+	v, _ := p.limiters.LoadOrStore(key, newTokenBucket(p.rateLimit.Rate, p.rateLimit.Burst))
+	return v.(*tokenBucket).allow()
+}
+
+// rateLimitMiddleware 包装 handler, 在转发请求之前做令牌桶限流
+func rateLimitMiddleware(next http.Handler, logger *proxyLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _, exists := findRoute(r.URL.Path)
+		if !exists || !p.rateLimit.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := rateLimitKey(p.rateLimit, r)
+		allowed, retryAfter := p.allowRequest(key)
+		if !allowed {
+			atomic.AddInt64(&p.rateLimitRejected, 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1)))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			logger.Printf("限流拒绝: %s %s key=%s", r.Method, r.URL.Path, key)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ------------------------------------------------------------------
+// 熔断器
+// ------------------------------------------------------------------
+
+type breakerState int32
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerConfig 是 routes.json 中单个路由的熔断配置
+type breakerConfig struct {
+	FailureThreshold     float64  `json:"failureThreshold"`     // 触发熔断的滑动窗口失败率(0~1)
+	MinRequests          int      `json:"minRequests"`          // 达到该请求数才评估失败率
+	Window               duration `json:"window"`               // 失败率统计窗口
+	Cooldown             duration `json:"cooldown"`             // Open 状态持续时间
+	HalfOpenProbes       int      `json:"halfOpenProbes"`       // Half-Open 允许放行的探测请求数
+	HalfOpenSuccessRatio float64  `json:"halfOpenSuccessRatio"` // 探测成功率达到该值才转回 Closed
+}
+
+func (c breakerConfig) enabled() bool {
+	return c.FailureThreshold > 0 && c.MinRequests > 0
+}
+
+// circuitBreaker 实现 Closed/Open/Half-Open 三态熔断
+type circuitBreaker struct {
+	cfg breakerConfig
+
+	mu           sync.Mutex
+	state        breakerState
+	windowStart  time.Time
+	total, fails int
+	openedAt     time.Time
+	probes, oks  int
+}
+
+func newCircuitBreaker(cfg breakerConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, windowStart: time.Now()}
+}
+
+// permit 判断当前请求是否允许放行; Open 状态下冷却结束会自动转入 Half-Open 并消耗一个探测名额
+func (cb *circuitBreaker) permit() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.cfg.Cooldown.value() {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.probes, cb.oks = 0, 0
+		fallthrough
+	case breakerHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenProbes {
+			return false
+		}
+		cb.probes++
+		return true
+	}
+	return true
+}
+
+// recordResult 记录一次调用结果, 驱动熔断状态机
+func (cb *circuitBreaker) recordResult(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerHalfOpen:
+		if success {
+			cb.oks++
+		}
+		if cb.probes >= cb.cfg.HalfOpenProbes {
+			if float64(cb.oks)/float64(cb.probes) >= cb.cfg.HalfOpenSuccessRatio {
+				cb.closeLocked()
+			} else {
+				cb.tripLocked()
+			}
+		}
+	case breakerClosed:
+		if time.Since(cb.windowStart) > cb.cfg.Window.value() {
+			cb.windowStart = time.Now()
+			cb.total, cb.fails = 0, 0
+		}
+		cb.total++
+		if !success {
+			cb.fails++
+		}
+		if cb.total >= cb.cfg.MinRequests && float64(cb.fails)/float64(cb.total) > cb.cfg.FailureThreshold {
+			cb.tripLocked()
+		}
+	}
+}
+
+func (cb *circuitBreaker) tripLocked() {
+	cb.state = breakerOpen
+	cb.openedAt = time.Now()
+}
+
+func (cb *circuitBreaker) closeLocked() {
+	cb.state = breakerClosed
+	cb.windowStart = time.Now()
+	cb.total, cb.fails = 0, 0
+}
+
+func (cb *circuitBreaker) snapshot() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state.String()
+}
+
+// ------------------------------------------------------------------
+// 管理端点: 暴露熔断器状态与限流拒绝计数, 便于运维排查降级路由
+// ------------------------------------------------------------------
+
+const adminStatusPath = "/__admin/status"
+
+type adminUpstreamStatus struct {
+	Target       string `json:"target"`
+	Healthy      bool   `json:"healthy"`
+	BreakerState string `json:"breakerState,omitempty"`
+}
+
+type adminRouteStatus struct {
+	Prefix            string                `json:"prefix"`
+	Policy            string                `json:"policy"`
+	RateLimitRejected int64                 `json:"rateLimitRejected"`
+	Upstreams         []adminUpstreamStatus `json:"upstreams"`
+}
+
+// adminStatusHandler 返回当前所有路由的熔断/限流/健康状态快照
+func adminStatusHandler(w http.ResponseWriter, r *http.Request) {
+	routeMutex.RLock()
+	snapshot := make([]adminRouteStatus, 0, len(routes))
+	for prefix, p := range routes {
+		rs := adminRouteStatus{
+			Prefix:            prefix,
+			Policy:            p.policy,
+			RateLimitRejected: atomic.LoadInt64(&p.rateLimitRejected),
+		}
+		for _, u := range p.upstreams {
+			us := adminUpstreamStatus{Target: u.target.String(), Healthy: u.isHealthy()}
+			if u.breaker != nil {
+				us.BreakerState = u.breaker.snapshot()
+			}
+			rs.Upstreams = append(rs.Upstreams, us)
+		}
+		snapshot = append(snapshot, rs)
+	}
+	routeMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 负载均衡策略
+const (
+	policyRoundRobin     = "round_robin"
+	policyWeighted       = "weighted"
+	policyConsistentHash = "consistent_hash"
+)
+
+// 一致性哈希虚拟节点数量
+const hashRingReplicas = 100
+
+// 路由协议类型
+const (
+	protocolHTTP = "http"
+	protocolWS   = "ws"
+	protocolGRPC = "grpc"
+)
+
+// defaultStreamTimeout 是 gRPC/长连接路由未显式配置 streamTimeout 时的默认值
+const defaultStreamTimeout = 1 * time.Hour
+
+// duration 支持从 "10s" 这样的字符串解析为 time.Duration
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) value() time.Duration {
+	return time.Duration(d)
+}
+
+// upstream 代表一个后端节点
+type upstream struct {
+	target  *url.URL
+	weight  int
+	healthy int32 // 原子标志: 1=健康, 0=不健康
+	fails   int32 // 连续失败计数
+	oks     int32 // 连续成功计数(不健康状态下使用)
+
+	breaker *circuitBreaker // 该节点的熔断器, 路由未配置熔断时为 nil
+}
+
+func newUpstream(rawURL string, weight int) (*upstream, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	return &upstream{target: target, weight: weight, healthy: 1}, nil
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+// available 综合健康检查和熔断器状态判断节点当前是否可以接收请求
+func (u *upstream) available() bool {
+	if !u.isHealthy() {
+		return false
+	}
+	if u.breaker != nil {
+		return u.breaker.permit()
+	}
+	return true
+}
+
+// recordOutcome 把一次请求结果同时喂给健康检查计数和熔断器
+func (u *upstream) recordOutcome(success bool, failThreshold, recoverThreshold int) {
+	if success {
+		u.markSuccess(recoverThreshold)
+	} else {
+		u.markFailure(failThreshold)
+	}
+	if u.breaker != nil {
+		u.breaker.recordResult(success)
+	}
+}
+
+// hashKeyConfig 描述一致性哈希取值来源
+type hashKeyConfig struct {
+	Type    string `json:"type"`    // header | cookie | path_regex
+	Name    string `json:"name"`    // header/cookie 名称
+	Pattern string `json:"pattern"` // path_regex 模式, 需包含一个捕获组
+
+	re *regexp.Regexp
+}
+
+// healthCheckConfig 健康检查配置
+type healthCheckConfig struct {
+	Path             string   `json:"path"`
+	Interval         duration `json:"interval"`
+	Timeout          duration `json:"timeout"`
+	FailThreshold    int      `json:"failThreshold"`
+	RecoverThreshold int      `json:"recoverThreshold"`
+}
+
+// upstreamConfig 是 routes.json 中单个上游节点的配置
+type upstreamConfig struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// routeConfig 是 routes.json 中单个路由前缀的配置
+type routeConfig struct {
+	Upstreams      []upstreamConfig  `json:"upstreams"`
+	Policy         string            `json:"policy"`
+	HashKey        hashKeyConfig     `json:"hashKey"`
+	HealthCheck    healthCheckConfig `json:"healthCheck"`
+	RetryBudget    int               `json:"retryBudget"`
+	RateLimit      rateLimitConfig   `json:"rateLimit"`
+	CircuitBreaker breakerConfig     `json:"circuitBreaker"`
+	Cache          cacheConfig       `json:"cache"`
+	Protocol       string            `json:"protocol"` // http(默认) | ws | grpc
+	StreamTimeout  duration          `json:"streamTimeout"`
+	FixedHeaders   map[string]string `json:"fixedHeaders,omitempty"`   // 覆盖全局固定请求头, 为空则沿用全局配置
+	TLSVerify      *bool             `json:"tlsVerify,omitempty"`      // 覆盖全局 TLS 证书校验开关, nil 表示沿用全局配置
+	RequestTimeout duration          `json:"requestTimeout,omitempty"` // 单次请求的端到端超时, 0 表示不限制
+}
+
+// pool 代表一个路由前缀背后的一组上游节点及其负载均衡状态
+type pool struct {
+	prefix      string
+	upstreams   []*upstream
+	policy      string
+	hashKey     hashKeyConfig
+	healthCheck healthCheckConfig
+	retryBudget int
+	counter     uint64 // 轮询计数器
+
+	ring   []ringEntry // 一致性哈希环, 仅在 policy 为 consistent_hash 时构建
+	stopHC chan struct{}
+
+	rateLimit         rateLimitConfig
+	limiters          sync.Map // client key -> *tokenBucket
+	rateLimitRejected int64    // 限流拒绝计数, 原子访问
+
+	breaker breakerConfig // 熔断配置模板, 每个上游节点各自持有一份 circuitBreaker 实例
+
+	cache       cacheConfig // 响应缓存规则
+	cacheHits   int64       // 缓存命中计数, 原子访问
+	cacheMisses int64       // 缓存未命中计数, 原子访问
+
+	protocol      string   // http | ws | grpc
+	streamTimeout duration // gRPC/长连接路由使用的读写超时, 替代全局 writeTimeout
+
+	fixedHeaders   map[string]string // 本路由生效的固定请求头, 已与全局配置合并, nil 表示沿用全局配置
+	skipTLSVerify  bool              // 本路由拨测上游时是否跳过 TLS 证书校验, 已与全局默认值合并
+	requestTimeout duration          // 单次请求的端到端超时, 0 表示不限制
+}
+
+type ringEntry struct {
+	hash uint64
+	node *upstream
+}
+
+// effectiveFixedHeaders 返回本路由实际生效的固定请求头: 路由覆盖优先于全局配置
+func (p *pool) effectiveFixedHeaders() map[string]string {
+	if p.fixedHeaders != nil {
+		return p.fixedHeaders
+	}
+	return activeFixedHeaders()
+}
+
+// newPool 根据配置构建一个 pool 实例
+func newPool(prefix string, cfg routeConfig) (*pool, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, fmt.Errorf("路由 %q 未配置任何上游节点", prefix)
+	}
+
+	p := &pool{
+		prefix:         prefix,
+		policy:         cfg.Policy,
+		hashKey:        cfg.HashKey,
+		healthCheck:    cfg.HealthCheck,
+		retryBudget:    cfg.RetryBudget,
+		stopHC:         make(chan struct{}),
+		rateLimit:      cfg.RateLimit,
+		breaker:        cfg.CircuitBreaker,
+		cache:          cfg.Cache,
+		protocol:       cfg.Protocol,
+		streamTimeout:  cfg.StreamTimeout,
+		requestTimeout: cfg.RequestTimeout,
+	}
+	if p.protocol == "" {
+		p.protocol = protocolHTTP
+	}
+	if p.streamTimeout.value() <= 0 {
+		p.streamTimeout = duration(defaultStreamTimeout)
+	}
+	if p.policy == "" {
+		p.policy = policyRoundRobin
+	}
+	if p.healthCheck.FailThreshold <= 0 {
+		p.healthCheck.FailThreshold = 3
+	}
+	if p.healthCheck.RecoverThreshold <= 0 {
+		p.healthCheck.RecoverThreshold = 2
+	}
+	if p.healthCheck.Interval.value() <= 0 {
+		p.healthCheck.Interval = duration(10 * time.Second)
+	}
+	if p.healthCheck.Timeout.value() <= 0 {
+		p.healthCheck.Timeout = duration(3 * time.Second)
+	}
+	if p.breaker.enabled() {
+		if p.breaker.Window.value() <= 0 {
+			p.breaker.Window = duration(10 * time.Second)
+		}
+		if p.breaker.Cooldown.value() <= 0 {
+			p.breaker.Cooldown = duration(30 * time.Second)
+		}
+		if p.breaker.HalfOpenProbes <= 0 {
+			p.breaker.HalfOpenProbes = 1
+		}
+		if p.breaker.HalfOpenSuccessRatio <= 0 {
+			p.breaker.HalfOpenSuccessRatio = 1
+		}
+	}
+
+	for _, uc := range cfg.Upstreams {
+		u, err := newUpstream(uc.URL, uc.Weight)
+		if err != nil {
+			return nil, fmt.Errorf("路由 %q 的上游地址 %q 无效: %w", prefix, uc.URL, err)
+		}
+		if p.breaker.enabled() {
+			u.breaker = newCircuitBreaker(p.breaker)
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	if p.policy == policyConsistentHash {
+		if p.hashKey.Pattern != "" {
+			re, err := regexp.Compile(p.hashKey.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("路由 %q 的 hashKey.pattern 无效: %w", prefix, err)
+			}
+			p.hashKey.re = re
+		}
+		p.buildRing()
+	}
+
+	if p.cache.enabled() {
+		if p.cache.PathRegex != "" {
+			re, err := regexp.Compile(p.cache.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("路由 %q 的 cache.pathRegex 无效: %w", prefix, err)
+			}
+			p.cache.re = re
+		}
+		if p.cache.TTL.value() <= 0 {
+			p.cache.TTL = duration(60 * time.Second)
+		}
+		if p.cache.MaxEntrySize <= 0 {
+			p.cache.MaxEntrySize = defaultCacheMaxEntrySize
+		}
+	}
+
+	return p, nil
+}
+
+// buildRing 构建一致性哈希环(每个节点按权重生成若干虚拟节点)
+func (p *pool) buildRing() {
+	var ring []ringEntry
+	for _, u := range p.upstreams {
+		replicas := hashRingReplicas * u.weight
+		for i := 0; i < replicas; i++ {
+			key := u.target.String() + "#" + strconv.Itoa(i)
+			ring = append(ring, ringEntry{hash: hashString(key), node: u})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	p.ring = ring
+}
+
+func hashString(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// hashRequestKey 从请求中提取一致性哈希所需要的键
+func (p *pool) hashRequestKey(r *http.Request) string {
+	switch p.hashKey.Type {
+	case "header":
+		return r.Header.Get(p.hashKey.Name)
+	case "cookie":
+		if c, err := r.Cookie(p.hashKey.Name); err == nil {
+			return c.Value
+		}
+		return ""
+	case "path_regex":
+		if p.hashKey.re != nil {
+			if m := p.hashKey.re.FindStringSubmatch(r.URL.Path); len(m) > 1 {
+				return m[1]
+			}
+		}
+		return r.URL.Path
+	default:
+		return r.URL.Path
+	}
+}
+
+// pickFromRing 在哈希环上为 key 找到第一个健康节点
+func (p *pool) pickFromRing(key string, excluded map[*upstream]bool) *upstream {
+	if len(p.ring) == 0 {
+		return nil
+	}
+	h := hashString(key)
+	idx := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		entry := p.ring[(idx+i)%len(p.ring)]
+		if entry.node.available() && !excluded[entry.node] {
+			return entry.node
+		}
+	}
+	return nil
+}
+
+// errNoHealthyUpstream 表示一个 pool 内没有可用的上游节点
+var errNoHealthyUpstream = fmt.Errorf("没有健康的上游节点")
+
+// errUpstreamFailure 由 ModifyResponse 在收到 5xx 时返回, 用于触发 ErrorHandler 做故障转移重试
+var errUpstreamFailure = fmt.Errorf("上游返回 5xx 响应")
+
+// ctxKey 是本包用于 context.Value 的私有 key 类型, 避免与标准库/其他包冲突
+type ctxKey int
+
+// attemptCtxKey 关联一次对外请求在故障转移过程中的状态
+// requestIDCtxKey 关联一次对外请求生成/透传的请求 ID, 供访问日志与 Director 转发时使用(见 accesslog.go)
+const (
+	attemptCtxKey ctxKey = iota
+	requestIDCtxKey
+)
+
+// proxyAttempt 记录一次请求在其路由池中的故障转移状态:
+// 已选中的节点、已经尝试过而被排除的节点、已用掉的重试次数
+type proxyAttempt struct {
+	pool      *pool
+	excluded  map[*upstream]bool
+	chosen    *upstream
+	attempts  int
+	noHealthy bool
+
+	rewrittenPath string    // Director 改写后的上游路径, 供访问日志记录
+	upstreamStart time.Time // Director 转发前的时间戳, 用于计算上游耗时
+	upstreamMs    float64   // ModifyResponse 记录的上游耗时(毫秒), 供访问日志记录
+
+	bodyReplay *bodyReplayBuffer // 请求体重放缓冲区, 无请求体的请求(如 GET)为 nil, 供 ErrorHandler 故障转移重试使用
+}
+
+// attemptFromContext 从请求 context 中取出 proxyAttempt, 未注入时返回 nil
+func attemptFromContext(ctx context.Context) *proxyAttempt {
+	v, _ := ctx.Value(attemptCtxKey).(*proxyAttempt)
+	return v
+}
+
+// pick 根据 pool 的负载均衡策略选择一个上游节点, excluded 中的节点会被跳过(用于故障转移重试)
+func (p *pool) pick(r *http.Request, excluded map[*upstream]bool) (*upstream, error) {
+	switch p.policy {
+	case policyConsistentHash:
+		if u := p.pickFromRing(p.hashRequestKey(r), excluded); u != nil {
+			return u, nil
+		}
+		return nil, errNoHealthyUpstream
+	case policyWeighted:
+		return p.pickWeighted(excluded)
+	default:
+		return p.pickRoundRobin(excluded)
+	}
+}
+
+func (p *pool) pickRoundRobin(excluded map[*upstream]bool) (*upstream, error) {
+	n := len(p.upstreams)
+	start := int(atomic.AddUint64(&p.counter, 1))
+	for i := 0; i < n; i++ {
+		u := p.upstreams[(start+i)%n]
+		if u.available() && !excluded[u] {
+			return u, nil
+		}
+	}
+	return nil, errNoHealthyUpstream
+}
+
+func (p *pool) pickWeighted(excluded map[*upstream]bool) (*upstream, error) {
+	var candidates []*upstream
+	total := 0
+	for _, u := range p.upstreams {
+		if u.available() && !excluded[u] {
+			candidates = append(candidates, u)
+			total += u.weight
+		}
+	}
+	if total == 0 {
+		return nil, errNoHealthyUpstream
+	}
+	r := rand.Intn(total)
+	for _, u := range candidates {
+		if r < u.weight {
+			return u, nil
+		}
+		r -= u.weight
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// markSuccess/markFailure 由 Director/ModifyResponse/健康检查共同维护节点健康状态
+func (u *upstream) markFailure(failThreshold int) {
+	atomic.StoreInt32(&u.oks, 0)
+	if atomic.AddInt32(&u.fails, 1) >= int32(failThreshold) {
+		atomic.StoreInt32(&u.healthy, 0)
+	}
+}
+
+func (u *upstream) markSuccess(recoverThreshold int) {
+	atomic.StoreInt32(&u.fails, 0)
+	if u.isHealthy() {
+		return
+	}
+	if atomic.AddInt32(&u.oks, 1) >= int32(recoverThreshold) {
+		atomic.StoreInt32(&u.healthy, 1)
+		atomic.StoreInt32(&u.oks, 0)
+	}
+}
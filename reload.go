@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configReloadDebounce 合并编辑器保存配置文件时连续触发的多个 fsnotify 事件
+const configReloadDebounce = 200 * time.Millisecond
+
+// startConfigReloader 监听配置文件变化并在变化时重新加载: 优先使用 fsnotify 做事件驱动监听,
+// 文件系统不支持 inotify 时退化为定时轮询; 同时响应 SIGHUP 作为运维手动触发重载的入口。
+// 每次触发都会顺带检查证书文件是否被原地替换, 实现证书轮换不重启。
+func startConfigReloader(path, certFile, keyFile string, logger *proxyLogger) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	reload := func(reason string) {
+		if err := loadAndApplyConfig(path, logger); err != nil {
+			logger.Printf("配置重载失败(%s): %v", reason, err)
+		}
+		if globalCertHolder != nil {
+			if err := globalCertHolder.reloadIfChanged(certFile, keyFile, logger); err != nil {
+				logger.Printf("证书重载失败(%s): %v", reason, err)
+			}
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Printf("fsnotify 不可用, 退化为每 %v 轮询一次配置文件: %v", reloadInterval, err)
+		go pollConfigFile(sigCh, reload)
+		return
+	}
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		logger.Printf("fsnotify 监听目录 %s 失败, 退化为轮询模式: %v", dir, err)
+		watcher.Close()
+		go pollConfigFile(sigCh, reload)
+		return
+	}
+
+	go watchConfigFile(watcher, path, sigCh, reload, logger)
+}
+
+// watchConfigFile 消费 fsnotify 事件, 对同一文件的连续写入做防抖后再触发重载
+func watchConfigFile(watcher *fsnotify.Watcher, path string, sigCh <-chan os.Signal, reload func(reason string), logger *proxyLogger) {
+	defer watcher.Close()
+
+	debounce := time.NewTimer(0)
+	if !debounce.Stop() {
+		<-debounce.C
+	}
+	pending := false
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			pending = true
+			debounce.Reset(configReloadDebounce)
+
+		case <-debounce.C:
+			if pending {
+				pending = false
+				reload("fsnotify")
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Printf("fsnotify 监听错误: %v", err)
+
+		case <-sigCh:
+			reload("SIGHUP")
+		}
+	}
+}
+
+// pollConfigFile 是 fsnotify 不可用时的退化方案, 沿用原有的定时轮询(内部按文件 mtime 判断是否真的变化)
+func pollConfigFile(sigCh <-chan os.Signal, reload func(reason string)) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reload("轮询")
+		case <-sigCh:
+			reload("SIGHUP")
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// wsIdleTimeout 是 WebSocket 转发中单个方向的读空闲超时
+const wsIdleTimeout = 60 * time.Second
+
+// isWebSocketUpgrade 判断请求是否为 WebSocket 升级请求
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// dialUpstream 按上游节点的 scheme 建立 TCP/TLS 连接, 供 WebSocket 劫持转发使用
+func dialUpstream(u *upstream, skipTLSVerify bool) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", u.target.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.target.Scheme == "https" || u.target.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			InsecureSkipVerify: skipTLSVerify,
+			ServerName:         u.target.Hostname(),
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return conn, nil
+}
+
+// proxyWebSocket 劫持客户端连接, 向选中的上游节点发起同样的升级请求, 然后在两端之间双向转发字节
+func proxyWebSocket(w http.ResponseWriter, r *http.Request, u *upstream, newPath string, p *pool, bufPool *bufferPool, logger *proxyLogger) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "服务器不支持连接劫持", http.StatusInternalServerError)
+		return
+	}
+
+	upstreamConn, err := dialUpstream(u, p.skipTLSVerify)
+	if err != nil {
+		logger.Printf("WebSocket 拨号上游失败: %s: %v", u.target.Host, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	outReq := r.Clone(r.Context())
+	outReq.URL.Scheme = u.target.Scheme
+	outReq.URL.Host = u.target.Host
+	outReq.URL.Path = newPath
+	outReq.Host = u.target.Host
+	for k, v := range p.effectiveFixedHeaders() {
+		outReq.Header.Set(k, v)
+	}
+	if err := outReq.Write(upstreamConn); err != nil {
+		logger.Printf("WebSocket 转发握手请求失败: %v", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	clientConn, brw, err := hj.Hijack()
+	if err != nil {
+		logger.Printf("劫持客户端连接失败: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	// Hijack 返回的 bufio.Reader 可能已经把握手请求之后、客户端紧跟着发来的首个 WS 帧
+	// 一并读进了缓冲区; 这部分字节不会再出现在 clientConn 的后续 Read 里, 必须先转发给上游,
+	// 否则流会从中间被截断
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered := make([]byte, n)
+		if _, err := io.ReadFull(brw.Reader, buffered); err != nil {
+			logger.Printf("读取已缓冲的 WebSocket 数据失败: %v", err)
+			return
+		}
+		if _, err := upstreamConn.Write(buffered); err != nil {
+			logger.Printf("转发已缓冲的 WebSocket 数据失败: %v", err)
+			return
+		}
+	}
+
+	logger.Printf("WebSocket 已建立: %s => %s%s", r.URL.Path, u.target.Host, newPath)
+
+	done := make(chan struct{}, 2)
+	go pumpConn(upstreamConn, clientConn, bufPool, done)
+	go pumpConn(clientConn, upstreamConn, bufPool, done)
+	<-done
+	<-done
+}
+
+// pumpConn 把 src 读到的数据原样写入 dst, 每次读取都会刷新空闲超时, 任一方向出错即退出
+func pumpConn(dst, src net.Conn, bufPool *bufferPool, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+
+	buf := bufPool.Get()
+	defer bufPool.Put(buf)
+
+	for {
+		src.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// extendDeadlinesForStreaming 对 gRPC 等长连接路由放宽 server 级别的读写超时,
+// 改用路由自己的 streamTimeout, 避免被全局 writeTimeout 提前切断
+func extendDeadlinesForStreaming(w http.ResponseWriter, timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(deadline)
+	_ = rc.SetWriteDeadline(deadline)
+}